@@ -0,0 +1,8 @@
+//go:build windows
+// +build windows
+
+package main
+
+// watchResize is a no-op on Windows, which has no SIGWINCH equivalent.
+func watchResize(onResize func()) {
+}
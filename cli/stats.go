@@ -6,18 +6,48 @@ package main
 import (
 	"bytes"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mgutz/ansi"
+	"golang.org/x/term"
 )
 
+// Reducers available for downsampling a chart's data points down to the
+// terminal width.
+const (
+	ReducerSum  = "sum"
+	ReducerAvg  = "avg"
+	ReducerMax  = "max"
+	ReducerP95  = "p95"
+	ReducerLTTB = "lttb"
+)
+
+var chartReducer string
+
+func init() {
+	flag.StringVar(&chartReducer, "chart-reducer", ReducerLTTB, "Downsampling reducer when a chart has more data points than terminal columns: sum|avg|max|p95|lttb")
+}
+
+// ChartOptions configures a single RenderChart call.
+type ChartOptions struct {
+	// Reducer is the downsampling strategy to use once the data no longer
+	// fits the terminal width. Defaults to the -chart-reducer flag.
+	Reducer string
+
+	// GroupBy, when non-empty, renders one sub-chart per distinct value of
+	// the named field instead of a single chart for inputData, e.g.
+	// GroupBy: "service" to see one line per service's volume over time.
+	GroupBy string
+}
+
 type Statistics struct {
 	verticalSep    string
 	horizontalSep  string
@@ -29,26 +59,57 @@ type Statistics struct {
 	colorReset     string
 }
 
+// defaultTerminalWidth/Height are used when the terminal size can't be
+// determined at all (e.g. piping cli output to a file in CI).
+const defaultTerminalWidth = 80
+const defaultTerminalHeight = 24
+
 func (s *Statistics) loadTerminalDimensions() {
-	cmd := exec.Command("stty", "size")
-	cmd.Stdin = os.Stdin
-	out, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
-	}
-	str := strings.TrimSpace(string(out))
-	split := strings.Split(str, " ")
-	height, _ := strconv.ParseInt(split[0], 10, 0)
-	width, _ := strconv.ParseInt(split[1], 10, 0)
-	s.terminalHeight = int(height)
-	s.terminalWidth = int(width)
+	if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		s.terminalWidth = width
+		s.terminalHeight = height
+	} else if width, height, ok := terminalSizeFromEnv(); ok {
+		s.terminalWidth = width
+		s.terminalHeight = height
+	} else {
+		log.Printf("Warning: could not determine terminal size (%s), falling back to %dx%d", err, defaultTerminalWidth, defaultTerminalHeight)
+		s.terminalWidth = defaultTerminalWidth
+		s.terminalHeight = defaultTerminalHeight
+	}
 	if verbose {
 		log.Println("Terminal dimension %dx%d (WxH)", s.terminalWidth, s.terminalHeight)
 	}
 }
 
-func (s *Statistics) RenderChart(filter *Filter, inputData map[int]map[int64]int64) (string, error) {
+// terminalSizeFromEnv falls back to $COLUMNS/$LINES, which shells export
+// for non-interactive children and which a user can set manually when
+// stdout isn't a tty (e.g. piping cli output to a file).
+func terminalSizeFromEnv() (int, int, bool) {
+	cols, err := strconv.ParseInt(strings.TrimSpace(os.Getenv("COLUMNS")), 10, 0)
+	if err != nil {
+		return 0, 0, false
+	}
+	lines, err := strconv.ParseInt(strings.TrimSpace(os.Getenv("LINES")), 10, 0)
+	if err != nil {
+		return 0, 0, false
+	}
+	return int(cols), int(lines), true
+}
+
+func (s *Statistics) RenderChart(filter *Filter, inputData map[int]map[int64]int64, opts *ChartOptions) (string, error) {
+	if opts == nil {
+		opts = &ChartOptions{}
+	}
+	if len(opts.GroupBy) > 0 {
+		return s.renderGroupedChart(filter, opts)
+	}
+	reducer := opts.Reducer
+	if len(reducer) < 1 {
+		reducer = chartReducer
+	}
+
 	// Random data (primary is top, secondary is filled, e.g. errors)
+	ts := make([]int64, 0)
 	data := make([]int64, 0)
 	dataSecondary := make([]int64, 0)
 	metricId := 1
@@ -56,15 +117,15 @@ func (s *Statistics) RenderChart(filter *Filter, inputData map[int]map[int64]int
 	if inputData[metricId] == nil || len(inputData[metricId]) < 1 {
 		return "", errors.New("Metrics not available for this filter")
 	}
-	// @todo Sort by TS
 	// To store the keys in slice in sorted order
 	var keys []int
-	for ts, _ := range inputData[metricId] {
-		keys = append(keys, int(ts))
+	for k, _ := range inputData[metricId] {
+		keys = append(keys, int(k))
 	}
 	sort.Ints(keys)
 	for _, k := range keys {
 		val := inputData[metricId][int64(k)]
+		ts = append(ts, int64(k))
 		data = append(data, val)
 
 		// Errors
@@ -77,11 +138,10 @@ func (s *Statistics) RenderChart(filter *Filter, inputData map[int]map[int64]int
 
 	// Width and height for chart
 	dataWidth := len(data)
-	if dataWidth > s.terminalWidth {
-		log.Println("Warning, truncating data to match terminal width")
-		data = data[:s.terminalWidth-1]
+	targetWidth := s.terminalWidth - 1
+	if dataWidth > targetWidth && targetWidth > 0 {
+		data, dataSecondary = downsample(ts, data, dataSecondary, targetWidth, reducer)
 		dataWidth = len(data)
-		// @todo Compress data (merge data points and get sums in order to fit in screen)
 	}
 	maxHeight := int(math.Min(float64(20), float64(s.terminalHeight-4))) // remove some for padding
 	maxWidth := int(math.Max(float64(dataWidth), float64(s.terminalWidth)))
@@ -158,6 +218,200 @@ func (s *Statistics) RenderChart(filter *Filter, inputData map[int]map[int64]int
 	return buf.String(), nil
 }
 
+// renderGroupedChart buckets filter.Results by the string value of
+// opts.GroupBy and renders one labelled sub-chart per distinct value,
+// reusing RenderChart's own pipeline (downsampling, reducer) for each.
+func (s *Statistics) renderGroupedChart(filter *Filter, opts *ChartOptions) (string, error) {
+	groups := groupResultsByField(filter.Results, opts.GroupBy)
+	if len(groups) < 1 {
+		return "", fmt.Errorf("No results with field %q to group by", opts.GroupBy)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(fmt.Sprintf("%s=%s\n", opts.GroupBy, key))
+		chart, err := s.RenderChart(filter, map[int]map[int64]int64{1: groups[key]}, &ChartOptions{Reducer: opts.Reducer})
+		if err != nil {
+			buf.WriteString(fmt.Sprintf("  %s\n", err))
+			continue
+		}
+		buf.WriteString(chart)
+	}
+	return buf.String(), nil
+}
+
+// groupResultsByField buckets a filter's matched results by the string
+// value of the given field, counting how many occurred in each result's
+// unix-second timestamp bucket. This is what lets RenderChart produce a
+// separate series per field value (e.g. one line per `service` among
+// results that matched a `service=="api" && ...` field expression).
+func groupResultsByField(results []*FilterResult, field string) map[string]map[int64]int64 {
+	groups := make(map[string]map[int64]int64)
+	for _, res := range results {
+		val, ok := res.Fields[field]
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%v", val)
+		bucket := res.Ts / int64(time.Second)
+		if groups[key] == nil {
+			groups[key] = make(map[int64]int64)
+		}
+		groups[key][bucket]++
+	}
+	return groups
+}
+
+// downsample buckets data (and its aligned dataSecondary series) down to at
+// most `buckets` points, either by aggregating each bucket with the given
+// reducer or, for ReducerLTTB, by picking the single most visually
+// representative point per bucket.
+func downsample(ts []int64, data []int64, dataSecondary []int64, buckets int, reducer string) ([]int64, []int64) {
+	if len(data) <= buckets {
+		return data, dataSecondary
+	}
+
+	if reducer == ReducerLTTB {
+		indices := lttbIndices(ts, data, buckets)
+		out := make([]int64, len(indices))
+		outSecondary := make([]int64, len(indices))
+		for i, idx := range indices {
+			out[i] = data[idx]
+			outSecondary[i] = dataSecondary[idx]
+		}
+		return out, outSecondary
+	}
+
+	return bucketReduce(data, buckets, reducer), bucketReduce(dataSecondary, buckets, reducer)
+}
+
+// bucketReduce splits values into contiguous groups of
+// ceil(len(values)/buckets) points (so at most `buckets` groups, the last of
+// which may be shorter) and aggregates each group with reducer.
+func bucketReduce(values []int64, buckets int, reducer string) []int64 {
+	bucketSize := int(math.Ceil(float64(len(values)) / float64(buckets)))
+	out := make([]int64, 0, buckets)
+	for start := 0; start < len(values); start += bucketSize {
+		end := start + bucketSize
+		if end > len(values) {
+			end = len(values)
+		}
+		out = append(out, reduceBucket(values[start:end], reducer))
+	}
+	return out
+}
+
+func reduceBucket(bucket []int64, reducer string) int64 {
+	switch reducer {
+	case ReducerSum:
+		var sum int64
+		for _, v := range bucket {
+			sum += v
+		}
+		return sum
+	case ReducerMax:
+		max := bucket[0]
+		for _, v := range bucket {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	case ReducerP95:
+		sorted := append([]int64(nil), bucket...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		idx := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= len(sorted) {
+			idx = len(sorted) - 1
+		}
+		return sorted[idx]
+	default: // ReducerAvg
+		var sum int64
+		for _, v := range bucket {
+			sum += v
+		}
+		return sum / int64(len(bucket))
+	}
+}
+
+// lttbIndices implements the Largest-Triangle-Three-Buckets downsampling
+// algorithm: it always keeps the first and last point, and for each of the
+// `buckets`-2 buckets in between picks the point that forms the largest
+// triangle with the previously chosen point and the average of the next
+// bucket.
+func lttbIndices(ts []int64, data []int64, buckets int) []int {
+	n := len(data)
+	if buckets >= n {
+		indices := make([]int, n)
+		for i := range indices {
+			indices[i] = i
+		}
+		return indices
+	}
+	if buckets < 3 {
+		return []int{0, n - 1}
+	}
+
+	indices := make([]int, 0, buckets)
+	indices = append(indices, 0)
+
+	bucketSize := float64(n-2) / float64(buckets-2)
+	prevIdx := 0
+
+	for i := 0; i < buckets-2; i++ {
+		// Range of the next bucket, used for its average point
+		nextStart := int(float64(i+1)*bucketSize) + 1
+		nextEnd := int(float64(i+2)*bucketSize) + 1
+		if nextEnd > n {
+			nextEnd = n
+		}
+		var avgX, avgY float64
+		for j := nextStart; j < nextEnd; j++ {
+			avgX += float64(ts[j])
+			avgY += float64(data[j])
+		}
+		count := float64(nextEnd - nextStart)
+		if count > 0 {
+			avgX /= count
+			avgY /= count
+		}
+
+		// Range of the current bucket, to search for the best point in
+		rangeStart := int(float64(i)*bucketSize) + 1
+		rangeEnd := int(float64(i+1)*bucketSize) + 1
+		if rangeEnd > n {
+			rangeEnd = n
+		}
+
+		ax, ay := float64(ts[prevIdx]), float64(data[prevIdx])
+		bestArea := -1.0
+		bestIdx := rangeStart
+		for j := rangeStart; j < rangeEnd; j++ {
+			bx, by := float64(ts[j]), float64(data[j])
+			area := math.Abs((ax-avgX)*(by-ay)-(ax-bx)*(avgY-ay)) / 2
+			if area > bestArea {
+				bestArea = area
+				bestIdx = j
+			}
+		}
+
+		indices = append(indices, bestIdx)
+		prevIdx = bestIdx
+	}
+
+	indices = append(indices, n-1)
+	return indices
+}
+
 func (s *Statistics) colorStr(currentColor string, desiredColorName string, str string) (string, string) {
 	if currentColor == desiredColorName {
 		return currentColor, str
@@ -185,3 +439,14 @@ func newStatistics() *Statistics {
 	s.loadTerminalDimensions()
 	return s
 }
+
+// WatchResize re-runs loadTerminalDimensions and invokes onResize whenever
+// the terminal is resized while a live-tail stream is running, so the chart
+// re-renders at the new size instead of staying stuck at whatever size it
+// had on startup. It's a no-op on platforms without SIGWINCH.
+func (s *Statistics) WatchResize(onResize func()) {
+	watchResize(func() {
+		s.loadTerminalDimensions()
+		onResize()
+	})
+}
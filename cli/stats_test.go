@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestBucketReduceSum(t *testing.T) {
+	values := []int64{1, 2, 3, 4, 5, 6}
+	got := bucketReduce(values, 3, ReducerSum)
+	want := []int64{3, 7, 11}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBucketReduceMax(t *testing.T) {
+	values := []int64{1, 9, 3, 2, 8, 4}
+	got := bucketReduce(values, 2, ReducerMax)
+	want := []int64{9, 8}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBucketReduceAvg(t *testing.T) {
+	values := []int64{2, 4, 6, 8}
+	got := bucketReduce(values, 2, ReducerAvg)
+	want := []int64{3, 7}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDownsampleNoopWhenWithinBudget(t *testing.T) {
+	ts := []int64{1, 2, 3}
+	data := []int64{10, 20, 30}
+	secondary := []int64{0, 1, 0}
+	outData, outSecondary := downsample(ts, data, secondary, 5, ReducerSum)
+	if len(outData) != 3 || len(outSecondary) != 3 {
+		t.Fatalf("expected downsample to be a no-op when data already fits, got %v / %v", outData, outSecondary)
+	}
+}
+
+func TestLttbIndicesKeepsEndpoints(t *testing.T) {
+	n := 20
+	ts := make([]int64, n)
+	data := make([]int64, n)
+	for i := 0; i < n; i++ {
+		ts[i] = int64(i)
+		data[i] = int64(i * i)
+	}
+
+	indices := lttbIndices(ts, data, 5)
+	if len(indices) != 5 {
+		t.Fatalf("got %d indices, want 5", len(indices))
+	}
+	if indices[0] != 0 {
+		t.Errorf("first index = %d, want 0", indices[0])
+	}
+	if indices[len(indices)-1] != n-1 {
+		t.Errorf("last index = %d, want %d", indices[len(indices)-1], n-1)
+	}
+	for i := 1; i < len(indices); i++ {
+		if indices[i] <= indices[i-1] {
+			t.Fatalf("indices must be strictly increasing, got %v", indices)
+		}
+	}
+}
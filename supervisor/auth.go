@@ -0,0 +1,390 @@
+// Pluggable authentication for the supervisor's HTTP API. Replaces the
+// hard-coded Basic Auth credentials with an Authenticator interface so
+// operators can front the supervisor with Basic, a static bearer token, or
+// corporate SSO via OIDC.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scope is a permission required to call a given route.
+type Scope string
+
+const (
+	ScopeFilterRead  Scope = "filter:read"
+	ScopeFilterWrite Scope = "filter:write"
+	ScopeFilterAdmin Scope = "filter:admin"
+)
+
+const (
+	AuthModeBasic  = "basic"
+	AuthModeBearer = "bearer"
+	AuthModeOIDC   = "oidc"
+)
+
+// AuthContext describes the caller that was authenticated for a request.
+type AuthContext struct {
+	Subject string
+	Scopes  map[Scope]bool
+}
+
+func (ctx *AuthContext) HasScope(scope Scope) bool {
+	return ctx != nil && ctx.Scopes[scope]
+}
+
+// Authenticator verifies a request's credentials and returns the resulting
+// AuthContext, or an error describing why authentication failed.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*AuthContext, error)
+}
+
+// allScopes grants every known scope, used by authenticators (Basic, static
+// bearer) that don't have a finer-grained notion of permissions.
+func allScopes() map[Scope]bool {
+	return map[Scope]bool{ScopeFilterRead: true, ScopeFilterWrite: true, ScopeFilterAdmin: true}
+}
+
+// BasicAuthenticator checks the request's `Authorization: Basic ...` header
+// against a single configured username/password pair.
+type BasicAuthenticator struct {
+	Username string
+	Password string
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*AuthContext, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errors.New("Missing Basic Authorization header")
+	}
+	usrMatch := subtle.ConstantTimeCompare([]byte(username), []byte(a.Username)) == 1
+	pwdMatch := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+	if !usrMatch || !pwdMatch {
+		return nil, errors.New("Invalid credentials")
+	}
+	return &AuthContext{Subject: username, Scopes: allScopes()}, nil
+}
+
+// BearerAuthenticator checks the request's `Authorization: Bearer ...`
+// header against a single static token.
+type BearerAuthenticator struct {
+	Token string
+}
+
+func (a *BearerAuthenticator) Authenticate(r *http.Request) (*AuthContext, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+		return nil, errors.New("Invalid bearer token")
+	}
+	return &AuthContext{Subject: "bearer", Scopes: allScopes()}, nil
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 1 {
+		return "", errors.New("Missing Authorization header")
+	}
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", errors.New("Expected a Bearer Authorization header")
+	}
+	return strings.TrimSpace(parts[1]), nil
+}
+
+// OIDCAuthenticator verifies `Authorization: Bearer <jwt>` tokens against an
+// OIDC provider's JWKS, checking `iss`, `aud` and `exp`, and mapping the
+// `roles` claim onto scopes.
+type OIDCAuthenticator struct {
+	Issuer   string
+	Audience string
+	ClientId string
+
+	jwks *jwksCache
+}
+
+func NewOIDCAuthenticator(issuer string, audience string, clientId string) *OIDCAuthenticator {
+	return &OIDCAuthenticator{
+		Issuer:   issuer,
+		Audience: audience,
+		ClientId: clientId,
+		jwks:     newJwksCache(issuer),
+	}
+}
+
+func (a *OIDCAuthenticator) Authenticate(r *http.Request) (*AuthContext, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != a.Issuer {
+		return nil, fmt.Errorf("Unexpected issuer %q", iss)
+	}
+	if !audienceMatches(claims["aud"], a.Audience) {
+		return nil, errors.New("Token audience does not match")
+	}
+	// When the IdP issues a token for multiple audiences, `aud` alone isn't
+	// enough to prove this client is the intended recipient; azp ("authorized
+	// party") is the claim meant for that, so check it against -oidc-client-id
+	// whenever the token carries one.
+	if len(a.ClientId) > 0 {
+		if azp, ok := claims["azp"].(string); ok && azp != a.ClientId {
+			return nil, errors.New("Token authorized party does not match client id")
+		}
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Unix(int64(exp), 0).Before(time.Now()) {
+		return nil, errors.New("Token expired")
+	}
+
+	subject, _ := claims["sub"].(string)
+	return &AuthContext{Subject: subject, Scopes: rolesToScopes(claims["roles"])}, nil
+}
+
+func audienceMatches(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rolesToScopes maps an OIDC `roles` claim onto the supervisor's scopes.
+// Anything not recognised is ignored rather than rejected outright, so
+// unrelated roles assigned by the IdP don't break authorization.
+func rolesToScopes(roles interface{}) map[Scope]bool {
+	scopes := make(map[Scope]bool)
+	list, _ := roles.([]interface{})
+	for _, r := range list {
+		switch Scope(fmt.Sprintf("%v", r)) {
+		case ScopeFilterRead:
+			scopes[ScopeFilterRead] = true
+		case ScopeFilterWrite:
+			scopes[ScopeFilterWrite] = true
+		case ScopeFilterAdmin:
+			scopes[ScopeFilterAdmin] = true
+		}
+	}
+	return scopes
+}
+
+// verify parses and validates the JWT's RS256 signature against the
+// provider's JWKS, returning its claims on success.
+func (a *OIDCAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed JWT")
+	}
+
+	var header struct {
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("Unsupported JWT alg %q", header.Alg)
+	}
+
+	key, err := a.jwks.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := parts[0] + "." + parts[1]
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(signed))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("Invalid JWT signature: %s", err)
+	}
+
+	payloadJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payloadJson, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// jwksCache fetches and caches a provider's JSON Web Key Set so every
+// request doesn't have to round-trip to the discovery endpoint.
+type jwksCache struct {
+	issuer    string
+	fetchedAt time.Time
+	keys      map[string]*rsa.PublicKey
+}
+
+const jwksCacheTTL = 10 * time.Minute
+
+func newJwksCache(issuer string) *jwksCache {
+	return &jwksCache{issuer: issuer, keys: make(map[string]*rsa.PublicKey)}
+}
+
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	if key, found := c.keys[kid]; found && time.Since(c.fetchedAt) < jwksCacheTTL {
+		return key, nil
+	}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	key, found := c.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("Unknown JWKS key id %q", kid)
+	}
+	return key, nil
+}
+
+func (c *jwksCache) refresh() error {
+	var discovery struct {
+		JwksUri string `json:"jwks_uri"`
+	}
+	if err := getJson(strings.TrimRight(c.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string   `json:"kid"`
+			Kty string   `json:"kty"`
+			N   string   `json:"n"`
+			E   string   `json:"e"`
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := getJson(discovery.JwksUri, &jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		if len(k.X5c) > 0 {
+			if cert, err := parseX509FromB64(k.X5c[0]); err == nil {
+				if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+					keys[k.Kid] = pub
+					continue
+				}
+			}
+		}
+		if pub, err := rsaKeyFromModExp(k.N, k.E); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	return nil
+}
+
+func parseX509FromB64(der string) (*x509.Certificate, error) {
+	raw, err := base64.StdEncoding.DecodeString(der)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(raw)
+}
+
+func rsaKeyFromModExp(nB64 string, eB64 string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(nB64)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(eB64)
+	if err != nil {
+		return nil, err
+	}
+	e := 0
+	for _, b := range eBytes {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: e}, nil
+}
+
+// httpClientTimeout bounds how long a single OIDC discovery/JWKS fetch may
+// take, so a slow or unresponsive IdP can't hang every request that needs a
+// fresh jwksCache (a plain http.Get has no timeout at all).
+const httpClientTimeout = 5 * time.Second
+
+var httpClient = &http.Client{Timeout: httpClientTimeout}
+
+func getJson(url string, dest interface{}) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
+
+// RequireScope is gin middleware that authenticates the request and aborts
+// with 401 unless the caller holds the given scope.
+func RequireScope(scope Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, err := authenticator.Authenticate(c.Request)
+		if err != nil || !ctx.HasScope(scope) {
+			c.Writer.Header().Set("WWW-Authenticate", `Basic realm="cloudpelican"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set("auth", ctx)
+		c.Next()
+	}
+}
+
+// newAuthenticator builds the configured Authenticator based on -auth-mode.
+func newAuthenticator(mode string, basicUser string, basicPwd string, oidcIssuer string, oidcAudience string, oidcClientId string) (Authenticator, error) {
+	switch mode {
+	case AuthModeBasic:
+		return &BasicAuthenticator{Username: basicUser, Password: basicPwd}, nil
+	case AuthModeBearer:
+		return &BearerAuthenticator{Token: basicPwd}, nil
+	case AuthModeOIDC:
+		if len(oidcIssuer) < 1 || len(oidcAudience) < 1 {
+			return nil, errors.New("-oidc-issuer and -oidc-audience are required in oidc auth mode")
+		}
+		return NewOIDCAuthenticator(oidcIssuer, oidcAudience, oidcClientId), nil
+	default:
+		return nil, fmt.Errorf("Unknown -auth-mode %q", mode)
+	}
+}
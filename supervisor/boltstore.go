@@ -0,0 +1,197 @@
+// BoltDB-backed Store implementation.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var filtersBucket = []byte("filters")
+
+// resultsBucketName namespaces a filter's results bucket so it sits
+// alongside "filters" instead of colliding with another filter's id.
+func resultsBucketName(filterId string) []byte {
+	return []byte(fmt.Sprintf("results:%s", filterId))
+}
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(filtersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) SaveFilter(f *Filter) error {
+	data, err := marshalFilter(f)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(resultsBucketName(f.Id)); err != nil {
+			return err
+		}
+		return tx.Bucket(filtersBucket).Put([]byte(f.Id), data)
+	})
+}
+
+func (s *BoltStore) DeleteFilter(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(filtersBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(resultsBucketName(id))
+	})
+}
+
+func (s *BoltStore) LoadFilters() ([]*Filter, error) {
+	var stored []storedFilter
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filtersBucket).ForEach(func(k, v []byte) error {
+			var sf storedFilter
+			if err := json.Unmarshal(v, &sf); err != nil {
+				return err
+			}
+			stored = append(stored, sf)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filters := make([]*Filter, 0, len(stored))
+	for _, sf := range stored {
+		results, err := s.LoadResults(sf.Id)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, rehydrateFilter(sf, results))
+	}
+	return filters, nil
+}
+
+// AppendResults writes every result of a single PUT batch in one
+// transaction: BoltDB fsyncs the transaction's write-ahead log entry before
+// Update returns, so by the time the handler acks the batch to the caller
+// it is durable, and a crash mid-batch leaves none of it committed.
+func (s *BoltStore) AppendResults(filterId string, results []*FilterResult) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(resultsBucketName(filterId))
+		if err != nil {
+			return err
+		}
+		for _, res := range results {
+			data, err := json.Marshal(res)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(resultKey(res.Ts), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) LoadResults(filterId string) ([]*FilterResult, error) {
+	var results []*FilterResult
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(resultsBucketName(filterId))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var res FilterResult
+			if err := json.Unmarshal(v, &res); err != nil {
+				return err
+			}
+			results = append(results, &res)
+			return nil
+		})
+	})
+	return results, err
+}
+
+// Compact enforces the retention policy by deleting the oldest results
+// first, since keys are ordered chronologically by timestamp.
+func (s *BoltStore) Compact(filterId string, policy RetentionPolicy) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(resultsBucketName(filterId))
+		if bucket == nil {
+			return nil
+		}
+
+		var keys [][]byte
+		var sizes []int
+		cutoff := time.Now().Add(-policy.MaxAge).UnixNano()
+		var totalBytes int64
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+			sizes = append(sizes, len(v))
+			totalBytes += int64(len(v))
+		}
+
+		toDelete := 0
+		if policy.MaxLines > 0 && len(keys) > policy.MaxLines {
+			toDelete = len(keys) - policy.MaxLines
+		}
+		if policy.MaxAge > 0 {
+			for i, k := range keys {
+				if i < toDelete {
+					continue
+				}
+				ts := int64(beUint64(k))
+				if ts < cutoff {
+					toDelete = i + 1
+				} else {
+					break
+				}
+			}
+		}
+		if policy.MaxBytes > 0 {
+			for i := 0; i < len(keys) && totalBytes > policy.MaxBytes; i++ {
+				if i >= toDelete {
+					toDelete = i + 1
+				}
+				totalBytes -= int64(sizes[i])
+			}
+		}
+
+		for i := 0; i < toDelete; i++ {
+			if err := bucket.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func beUint64(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
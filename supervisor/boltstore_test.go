@@ -0,0 +1,139 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBoltStore(t *testing.T) *BoltStore {
+	t.Helper()
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestCompactMaxLines(t *testing.T) {
+	store := newTestBoltStore(t)
+	filter := &Filter{Id: "f1"}
+	if err := store.SaveFilter(filter); err != nil {
+		t.Fatalf("SaveFilter: %s", err)
+	}
+
+	results := make([]*FilterResult, 0, 10)
+	for i := 0; i < 10; i++ {
+		results = append(results, &FilterResult{Ts: int64(i + 1), Raw: "line"})
+	}
+	if err := store.AppendResults(filter.Id, results); err != nil {
+		t.Fatalf("AppendResults: %s", err)
+	}
+
+	if err := store.Compact(filter.Id, RetentionPolicy{MaxLines: 3}); err != nil {
+		t.Fatalf("Compact: %s", err)
+	}
+
+	remaining, err := store.LoadResults(filter.Id)
+	if err != nil {
+		t.Fatalf("LoadResults: %s", err)
+	}
+	if len(remaining) != 3 {
+		t.Fatalf("got %d results after compaction, want 3", len(remaining))
+	}
+	// The oldest results (lowest Ts) should be the ones dropped.
+	for _, r := range remaining {
+		if r.Ts < 8 {
+			t.Errorf("unexpected surviving result with Ts=%d, oldest should have been compacted away", r.Ts)
+		}
+	}
+}
+
+// TestLoadFiltersRehydratesRegexAndFieldExpr guards against LoadFilters only
+// copying storedFilter's exported metadata fields: it reopens a fresh
+// BoltStore/FilterManager against the same file and checks that matching
+// still works, which is only possible if rehydrateFilter actually recompiled
+// the unexported regex/fieldExpr from the persisted strings.
+func TestLoadFiltersRehydratesRegexAndFieldExpr(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	store, err := NewBoltStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %s", err)
+	}
+	fm, err := NewFilterManagerWithStore(store)
+	if err != nil {
+		t.Fatalf("NewFilterManagerWithStore: %s", err)
+	}
+	id, err := fm.CreateStructuredFilter("errors", "127.0.0.1", "boom", FormatJson, `level=="error"`)
+	if err != nil {
+		t.Fatalf("CreateStructuredFilter: %s", err)
+	}
+	fm.GetFilter(id).AddResults([]string{
+		`{"level":"error","msg":"boom"}`,
+		`{"level":"info","msg":"fine"}`,
+	})
+	store.Close()
+
+	reopened, err := NewBoltStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewBoltStore (reopen): %s", err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+	restarted, err := NewFilterManagerWithStore(reopened)
+	if err != nil {
+		t.Fatalf("NewFilterManagerWithStore (reopen): %s", err)
+	}
+
+	filter := restarted.GetFilter(id)
+	if filter == nil {
+		t.Fatalf("filter %s not found after reopen", id)
+	}
+	if len(filter.Results) != 1 || filter.Results[0].Raw != `{"level":"error","msg":"boom"}` {
+		t.Fatalf("rehydrated filter has unexpected results: %+v", filter.Results)
+	}
+
+	// A regex/fieldExpr that only survived as zero-value unexported fields
+	// would accept more than it should: rejecting the info line (which
+	// matches the regex) proves fieldExpr was recompiled, and rejecting the
+	// error line without "boom" (which matches fieldExpr) proves the regex was.
+	accepted := filter.AddResults([]string{
+		`{"level":"error","msg":"boom again"}`,
+		`{"level":"info","msg":"boom but fine"}`,
+		`{"level":"error","msg":"no match"}`,
+	})
+	if accepted != 1 {
+		t.Fatalf("got %d accepted after reopen, want 1 (regex/fieldExpr not recompiled)", accepted)
+	}
+	if len(filter.Results) != 2 || filter.Results[1].Raw != `{"level":"error","msg":"boom again"}` {
+		t.Fatalf("unexpected results after reopen: %+v", filter.Results)
+	}
+}
+
+func TestCompactMaxAge(t *testing.T) {
+	store := newTestBoltStore(t)
+	filter := &Filter{Id: "f1"}
+	if err := store.SaveFilter(filter); err != nil {
+		t.Fatalf("SaveFilter: %s", err)
+	}
+
+	now := time.Now()
+	old := &FilterResult{Ts: now.Add(-2 * time.Hour).UnixNano(), Raw: "old"}
+	fresh := &FilterResult{Ts: now.UnixNano(), Raw: "fresh"}
+	if err := store.AppendResults(filter.Id, []*FilterResult{old, fresh}); err != nil {
+		t.Fatalf("AppendResults: %s", err)
+	}
+
+	if err := store.Compact(filter.Id, RetentionPolicy{MaxAge: time.Hour}); err != nil {
+		t.Fatalf("Compact: %s", err)
+	}
+
+	remaining, err := store.LoadResults(filter.Id)
+	if err != nil {
+		t.Fatalf("LoadResults: %s", err)
+	}
+	if len(remaining) != 1 || remaining[0].Raw != "fresh" {
+		t.Fatalf("got %+v, want only the fresh result to survive", remaining)
+	}
+}
@@ -0,0 +1,130 @@
+// A small expression language for filtering parsed log fields, e.g.
+// `level=="error" && service=="api" && latency_ms>500`. Only conjunctions
+// of simple comparisons are supported, which covers the field filters the
+// storm topology and cli need.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type fieldOp string
+
+const (
+	opEq fieldOp = "=="
+	opNe fieldOp = "!="
+	opGt fieldOp = ">"
+	opGe fieldOp = ">="
+	opLt fieldOp = "<"
+	opLe fieldOp = "<="
+)
+
+// fieldCond is a single `field <op> value` comparison.
+type fieldCond struct {
+	field string
+	op    fieldOp
+	value string
+}
+
+// fieldExpr is a conjunction ("&&") of fieldConds.
+type fieldExpr struct {
+	conds []fieldCond
+}
+
+// parseFieldExpr parses expressions of the form:
+//
+//	level=="error" && service=="api" && latency_ms>500
+func parseFieldExpr(expr string) (*fieldExpr, error) {
+	fe := &fieldExpr{}
+	for _, part := range strings.Split(expr, "&&") {
+		cond, err := parseFieldCond(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		fe.conds = append(fe.conds, cond)
+	}
+	if len(fe.conds) < 1 {
+		return nil, fmt.Errorf("No conditions found in field expression %q", expr)
+	}
+	return fe, nil
+}
+
+func parseFieldCond(part string) (fieldCond, error) {
+	for _, op := range []fieldOp{opEq, opNe, opGe, opLe, opGt, opLt} {
+		idx := strings.Index(part, string(op))
+		if idx < 0 {
+			continue
+		}
+		field := strings.TrimSpace(part[:idx])
+		value := strings.TrimSpace(part[idx+len(op):])
+		value = strings.Trim(value, "\"")
+		if len(field) < 1 {
+			return fieldCond{}, fmt.Errorf("Missing field name in condition %q", part)
+		}
+		return fieldCond{field: field, op: op, value: value}, nil
+	}
+	return fieldCond{}, fmt.Errorf("Unsupported condition %q", part)
+}
+
+// Eval evaluates the expression against a parsed field map. All conditions
+// must hold for the expression to match.
+func (fe *fieldExpr) Eval(fields map[string]interface{}) bool {
+	for _, c := range fe.conds {
+		if !c.eval(fields[c.field]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c fieldCond) eval(actual interface{}) bool {
+	if actual == nil {
+		return false
+	}
+
+	// Numeric comparison if both sides look like numbers
+	if actualNum, ok := toFloat(actual); ok {
+		if wantNum, err := strconv.ParseFloat(c.value, 64); err == nil {
+			switch c.op {
+			case opEq:
+				return actualNum == wantNum
+			case opNe:
+				return actualNum != wantNum
+			case opGt:
+				return actualNum > wantNum
+			case opGe:
+				return actualNum >= wantNum
+			case opLt:
+				return actualNum < wantNum
+			case opLe:
+				return actualNum <= wantNum
+			}
+		}
+	}
+
+	// Fall back to string comparison (only == and != make sense here)
+	actualStr := fmt.Sprintf("%v", actual)
+	switch c.op {
+	case opEq:
+		return actualStr == c.value
+	case opNe:
+		return actualStr != c.value
+	default:
+		return false
+	}
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestParseFieldCond(t *testing.T) {
+	cond, err := parseFieldCond(`level=="error"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cond.field != "level" || cond.op != opEq || cond.value != "error" {
+		t.Fatalf("unexpected cond: %+v", cond)
+	}
+
+	if _, err := parseFieldCond("nonsense"); err == nil {
+		t.Fatal("expected an error for an unsupported condition")
+	}
+}
+
+func TestFieldExprEval(t *testing.T) {
+	fe, err := parseFieldExpr(`level=="error" && service=="api" && latency_ms>500`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	match := map[string]interface{}{"level": "error", "service": "api", "latency_ms": 501.0}
+	if !fe.Eval(match) {
+		t.Fatal("expected the expression to match")
+	}
+
+	tooFast := map[string]interface{}{"level": "error", "service": "api", "latency_ms": 100.0}
+	if fe.Eval(tooFast) {
+		t.Fatal("expected the expression not to match a lower latency")
+	}
+
+	missingField := map[string]interface{}{"level": "error"}
+	if fe.Eval(missingField) {
+		t.Fatal("expected the expression not to match when a field is absent")
+	}
+}
+
+func TestFieldExprNumericComparisons(t *testing.T) {
+	fe, err := parseFieldExpr("retries>=3")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !fe.Eval(map[string]interface{}{"retries": 3.0}) {
+		t.Fatal("expected retries==3 to satisfy retries>=3")
+	}
+	if fe.Eval(map[string]interface{}{"retries": 2.0}) {
+		t.Fatal("expected retries==2 to fail retries>=3")
+	}
+}
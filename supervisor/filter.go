@@ -0,0 +1,357 @@
+// Filters hold the regex (and optionally structured field) matching rules
+// that the storm topology pushes log lines through, plus the results that
+// have matched so far.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Supported values for the `format` query param on POST /filter.
+const (
+	FormatRaw    = "raw"
+	FormatJson   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// FilterResult is a single matched log line, optionally carrying its parsed
+// structured fields alongside the raw text.
+type FilterResult struct {
+	Ts     int64                  `json:"ts"`
+	Raw    string                 `json:"raw"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Filter is a single named regex (and optional field expression) that log
+// lines get matched against.
+type Filter struct {
+	Id          string          `json:"id"`
+	Name        string          `json:"name"`
+	CreatorAddr string          `json:"creator_addr"`
+	Regex       string          `json:"regex"`
+	Format      string          `json:"format"`
+	FieldExpr   string          `json:"field_expr,omitempty"`
+	Results     []*FilterResult `json:"results"`
+
+	regex       *regexp.Regexp
+	fieldExpr   *fieldExpr
+	mux         sync.RWMutex
+	subscribers map[string]*subscriber
+	subMux      sync.RWMutex
+	store       Store
+}
+
+// FilterSummary is the metadata-only view of a Filter returned by endpoints
+// like GetFilter that list filters without their (potentially large)
+// results. It's a plain value, not a pointer into the live Filter, so
+// callers can never accidentally nil out Results on the real filter.
+type FilterSummary struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	CreatorAddr string `json:"creator_addr"`
+	Regex       string `json:"regex"`
+	Format      string `json:"format"`
+	FieldExpr   string `json:"field_expr,omitempty"`
+}
+
+// Summary returns a snapshot of the filter's metadata, without its Results.
+func (f *Filter) Summary() *FilterSummary {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	return &FilterSummary{
+		Id:          f.Id,
+		Name:        f.Name,
+		CreatorAddr: f.CreatorAddr,
+		Regex:       f.Regex,
+		Format:      f.Format,
+		FieldExpr:   f.FieldExpr,
+	}
+}
+
+// ResultsSnapshot returns a copy of the filter's currently matched results,
+// safe to read without racing AddResults's locked appends.
+func (f *Filter) ResultsSnapshot() []*FilterResult {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	results := make([]*FilterResult, len(f.Results))
+	copy(results, f.Results)
+	return results
+}
+
+// rehydrateFilter reconstructs a live Filter (compiled regex/field
+// expression, loaded results) from what the store persisted, used on
+// startup to restore filters created before a restart.
+func rehydrateFilter(sf storedFilter, results []*FilterResult) *Filter {
+	f := &Filter{
+		Id:          sf.Id,
+		Name:        sf.Name,
+		CreatorAddr: sf.CreatorAddr,
+		Regex:       sf.Regex,
+		Format:      sf.Format,
+		FieldExpr:   sf.FieldExpr,
+		Results:     results,
+	}
+	f.regex, _ = regexp.Compile(sf.Regex)
+	if len(sf.FieldExpr) > 0 {
+		f.fieldExpr, _ = parseFieldExpr(sf.FieldExpr)
+	}
+	return f
+}
+
+// subscriberBufferSize is the number of pending results a slow /stream
+// consumer is allowed to lag behind before older results get dropped.
+const subscriberBufferSize = 256
+
+// subscriber is a single live /filter/:id/stream connection's mailbox.
+type subscriber struct {
+	ch chan *FilterResult
+}
+
+// Subscribe registers a new stream subscriber and returns its id (used to
+// Unsubscribe later) and the channel new results get pushed on.
+func (f *Filter) Subscribe() (string, chan *FilterResult) {
+	f.subMux.Lock()
+	defer f.subMux.Unlock()
+	if f.subscribers == nil {
+		f.subscribers = make(map[string]*subscriber)
+	}
+	id := newFilterId()
+	sub := &subscriber{ch: make(chan *FilterResult, subscriberBufferSize)}
+	f.subscribers[id] = sub
+	return id, sub.ch
+}
+
+// Unsubscribe removes and closes a subscriber's mailbox.
+func (f *Filter) Unsubscribe(id string) {
+	f.subMux.Lock()
+	defer f.subMux.Unlock()
+	if sub, found := f.subscribers[id]; found {
+		delete(f.subscribers, id)
+		close(sub.ch)
+	}
+}
+
+// publish fans a newly matched result out to every live subscriber. Slow
+// subscribers get their oldest buffered result dropped rather than
+// blocking the producer (the storm topology pushing via PUT).
+func (f *Filter) publish(res *FilterResult) {
+	f.subMux.RLock()
+	defer f.subMux.RUnlock()
+	for _, sub := range f.subscribers {
+		select {
+		case sub.ch <- res:
+		default:
+			// Buffer full: drop the oldest queued result, then retry once.
+			select {
+			case <-sub.ch:
+			default:
+			}
+			select {
+			case sub.ch <- res:
+			default:
+			}
+		}
+	}
+}
+
+// AddResults parses, matches and stores any of the given lines that satisfy
+// the filter's regex and (if present) field expression. The field expression
+// is only evaluated for json/logfmt filters; raw filters match on the regex
+// alone. It returns the number of lines that were accepted.
+func (f *Filter) AddResults(lines []string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	accepted := make([]*FilterResult, 0, len(lines))
+	for _, line := range lines {
+		if f.regex != nil && !f.regex.MatchString(line) {
+			continue
+		}
+
+		var fields map[string]interface{}
+		if f.Format == FormatJson || f.Format == FormatLogfmt {
+			var err error
+			fields, err = parseFields(f.Format, line)
+			if err != nil {
+				// Not parseable as the declared format, skip rather than fail the batch
+				continue
+			}
+			if f.fieldExpr != nil && !f.fieldExpr.Eval(fields) {
+				continue
+			}
+		}
+
+		accepted = append(accepted, &FilterResult{
+			Ts:     time.Now().UnixNano(),
+			Raw:    line,
+			Fields: fields,
+		})
+	}
+
+	if len(accepted) < 1 {
+		return 0
+	}
+
+	// Persist the whole batch as a single WAL-style append before acking it,
+	// so a crash between PUT and the caller seeing the ack can't lose lines
+	// that were supposedly accepted.
+	if f.store != nil {
+		if err := f.store.AppendResults(f.Id, accepted); err != nil {
+			log.Printf("Failed to persist %d result(s) for filter %s: %s", len(accepted), f.Id, err)
+			return 0
+		}
+	}
+
+	for _, result := range accepted {
+		f.Results = append(f.Results, result)
+		f.publish(result)
+	}
+	return len(accepted)
+}
+
+// FilterManager keeps track of all filters that have been created.
+type FilterManager struct {
+	filters map[string]*Filter
+	mux     sync.RWMutex
+	store   Store
+}
+
+// NewFilterManager creates an empty, in-memory-only FilterManager, for
+// callers that don't need persistence (e.g. unit tests).
+func NewFilterManager() *FilterManager {
+	return &FilterManager{
+		filters: make(map[string]*Filter),
+	}
+}
+
+// NewFilterManagerWithStore creates a FilterManager backed by store,
+// rehydrating any filters (and their results) the store already has.
+func NewFilterManagerWithStore(store Store) (*FilterManager, error) {
+	fm := &FilterManager{
+		filters: make(map[string]*Filter),
+		store:   store,
+	}
+	filters, err := store.LoadFilters()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range filters {
+		f.store = store
+		fm.filters[f.Id] = f
+	}
+	return fm, nil
+}
+
+// CreateFilter creates a plain raw-regex filter, kept around for backwards
+// compatibility with callers that don't care about structured fields.
+func (fm *FilterManager) CreateFilter(name string, creatorAddr string, regex string) (string, error) {
+	return fm.CreateStructuredFilter(name, creatorAddr, regex, FormatRaw, "")
+}
+
+// CreateStructuredFilter creates a filter that, in addition to the raw regex,
+// parses matched lines as the given format and (optionally) evaluates a field
+// expression such as `level=="error" && latency_ms>500` before accepting them.
+func (fm *FilterManager) CreateStructuredFilter(name string, creatorAddr string, regex string, format string, expr string) (string, error) {
+	if len(format) < 1 {
+		format = FormatRaw
+	}
+	if format != FormatRaw && format != FormatJson && format != FormatLogfmt {
+		return "", fmt.Errorf("Unknown format %s", format)
+	}
+
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return "", err
+	}
+
+	var fe *fieldExpr
+	if len(expr) > 0 {
+		fe, err = parseFieldExpr(expr)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	f := &Filter{
+		Id:          newFilterId(),
+		Name:        name,
+		CreatorAddr: creatorAddr,
+		Regex:       regex,
+		Format:      format,
+		FieldExpr:   expr,
+		Results:     make([]*FilterResult, 0),
+		regex:       re,
+		fieldExpr:   fe,
+		store:       fm.store,
+	}
+
+	if fm.store != nil {
+		if err := fm.store.SaveFilter(f); err != nil {
+			return "", err
+		}
+	}
+
+	fm.mux.Lock()
+	fm.filters[f.Id] = f
+	fm.mux.Unlock()
+
+	return f.Id, nil
+}
+
+func (fm *FilterManager) GetFilter(id string) *Filter {
+	fm.mux.RLock()
+	defer fm.mux.RUnlock()
+	return fm.filters[id]
+}
+
+func (fm *FilterManager) GetFilters() []*Filter {
+	fm.mux.RLock()
+	defer fm.mux.RUnlock()
+	filters := make([]*Filter, 0, len(fm.filters))
+	for _, f := range fm.filters {
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+func (fm *FilterManager) DeleteFilter(id string) bool {
+	fm.mux.Lock()
+	defer fm.mux.Unlock()
+	if _, found := fm.filters[id]; !found {
+		return false
+	}
+	if fm.store != nil {
+		if err := fm.store.DeleteFilter(id); err != nil {
+			log.Printf("Failed to delete filter %s from store: %s", id, err)
+			return false
+		}
+	}
+	delete(fm.filters, id)
+	return true
+}
+
+// Compact runs the store's retention policy against every known filter.
+// Intended to be called periodically by a background compactor.
+func (fm *FilterManager) Compact(policy RetentionPolicy) {
+	if fm.store == nil {
+		return
+	}
+	for _, f := range fm.GetFilters() {
+		if err := fm.store.Compact(f.Id, policy); err != nil {
+			log.Printf("Failed to compact filter %s: %s", f.Id, err)
+		}
+	}
+}
+
+func newFilterId() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
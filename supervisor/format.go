@@ -0,0 +1,94 @@
+// Parsing of structured log lines (JSON or logfmt) into a flat field map so
+// they can be evaluated by a fieldExpr and returned alongside the raw line.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseFields parses a single log line as the given format into a map of
+// field name to value. Logfmt values are string, float64 or bool; JSON values
+// are whatever encoding/json decodes, so nested objects and arrays are kept
+// as-is rather than flattened.
+func parseFields(format string, line string) (map[string]interface{}, error) {
+	switch format {
+	case FormatJson:
+		return parseJsonFields(line)
+	case FormatLogfmt:
+		return parseLogfmtFields(line)
+	default:
+		return nil, fmt.Errorf("Unknown format %s", format)
+	}
+}
+
+func parseJsonFields(line string) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// parseLogfmtFields parses `key=value key2="value with spaces" key3=1.5`
+// style lines, e.g. what heroku/logfmt produce.
+func parseLogfmtFields(line string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	for _, token := range splitLogfmt(line) {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 || len(kv[0]) < 1 {
+			continue
+		}
+		key := kv[0]
+		val := strings.Trim(kv[1], "\"")
+		fields[key] = coerceFieldValue(val)
+	}
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("No logfmt pairs found in line")
+	}
+	return fields, nil
+}
+
+// splitLogfmt splits on whitespace while keeping quoted "key=value value"
+// segments together.
+func splitLogfmt(line string) []string {
+	var tokens []string
+	var cur strings.Builder
+	inQuotes := false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			cur.WriteRune(r)
+		case r == ' ' && !inQuotes:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+// coerceFieldValue turns a raw string field value into a bool, float64 or
+// string, mirroring how encoding/json would have typed it.
+func coerceFieldValue(val string) interface{} {
+	// Numbers first: strconv.ParseBool also accepts "0"/"1", which would
+	// otherwise misclassify common numeric fields (retries=1, success=0) as
+	// bool instead of float64.
+	if f, err := strconv.ParseFloat(val, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(val); err == nil {
+		return b
+	}
+	return val
+}
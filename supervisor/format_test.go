@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestCoerceFieldValue(t *testing.T) {
+	cases := map[string]interface{}{
+		"1":     float64(1),
+		"0":     float64(0),
+		"1.5":   float64(1.5),
+		"true":  true,
+		"false": false,
+		"api":   "api",
+	}
+	for input, want := range cases {
+		got := coerceFieldValue(input)
+		if got != want {
+			t.Errorf("coerceFieldValue(%q) = %#v, want %#v", input, got, want)
+		}
+	}
+}
+
+func TestParseLogfmtFields(t *testing.T) {
+	fields, err := parseLogfmtFields(`level=error service=api latency_ms=501 msg="request failed"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fields["level"] != "error" {
+		t.Errorf("level = %#v, want \"error\"", fields["level"])
+	}
+	if fields["latency_ms"] != float64(501) {
+		t.Errorf("latency_ms = %#v, want 501", fields["latency_ms"])
+	}
+	if fields["msg"] != "request failed" {
+		t.Errorf("msg = %#v, want \"request failed\"", fields["msg"])
+	}
+}
+
+func TestParseLogfmtFieldsEmpty(t *testing.T) {
+	if _, err := parseLogfmtFields("not a logfmt line"); err == nil {
+		t.Fatal("expected an error when no key=value pairs are found")
+	}
+}
@@ -0,0 +1,101 @@
+// Gin middleware chain shared by every route: panic recovery (via
+// gin.Recovery in main), request ids, structured access logs, and gzip
+// compression. CORS is handled here too since the cli and any browser
+// dashboards hit this API directly.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader is the header new request ids are published on, both in
+// the response (so the caller can correlate) and in access logs.
+const RequestIDHeader = "X-Request-Id"
+
+// RequestID injects a UUID per request, reusing one supplied by an
+// upstream proxy if present.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if len(id) < 1 {
+			id = uuid.New().String()
+		}
+		c.Set("request_id", id)
+		c.Writer.Header().Set(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// StructuredLogger writes one JSON log line per request with the
+// fields operators grep dashboards for: request id, method, path, status
+// and latency.
+func StructuredLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		entry, _ := json.Marshal(map[string]interface{}{
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"latency":    time.Since(start).String(),
+			"request_id": c.GetString("request_id"),
+			"remote":     c.ClientIP(),
+		})
+		log.Println(string(entry))
+	}
+}
+
+// CORS allows the cli/dashboard to call the supervisor's API from a browser
+// origin different from the one it's served on.
+func CORS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// gzipResponseWriter wraps gin.ResponseWriter so writes are transparently
+// compressed.
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	writer *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	return w.writer.Write(data)
+}
+
+// Gzip compresses response bodies for clients that advertise support for
+// it; streaming endpoints (SSE) opt out since gzip would buffer and break
+// the flush-per-event behaviour.
+func Gzip() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") || strings.HasSuffix(c.Request.URL.Path, "/stream") {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Set("Content-Encoding", "gzip")
+		c.Writer.Header().Del("Content-Length")
+
+		gz := gzip.NewWriter(c.Writer)
+		defer gz.Close()
+		c.Writer = &gzipResponseWriter{ResponseWriter: c.Writer, writer: gz}
+		c.Next()
+	}
+}
@@ -0,0 +1,70 @@
+// Persistence for filters and their matched results. The `-db-file` flag
+// used to be accepted and ignored; this wires it up to an embedded BoltDB
+// so the supervisor survives restarts instead of losing everything held in
+// memory.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// RetentionPolicy bounds how much history a single filter's results are
+// allowed to keep before the compactor trims them.
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxLines int
+	MaxBytes int64
+}
+
+// Store persists filters and their results so the supervisor can rehydrate
+// after a restart. AppendResults is expected to be atomic per call: either
+// the whole batch is durably committed (and thus safe to ack to the PUT
+// caller) or none of it is.
+type Store interface {
+	SaveFilter(f *Filter) error
+	DeleteFilter(id string) error
+	LoadFilters() ([]*Filter, error)
+
+	AppendResults(filterId string, results []*FilterResult) error
+	LoadResults(filterId string) ([]*FilterResult, error)
+
+	// Compact enforces the retention policy for a single filter's results.
+	Compact(filterId string, policy RetentionPolicy) error
+
+	Close() error
+}
+
+// storedFilter is the on-disk representation of a Filter: the same fields
+// that get marshalled to API clients, minus Results (which live in their
+// own per-filter bucket so they can be appended to and compacted
+// independently of the filter's metadata).
+type storedFilter struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	CreatorAddr string `json:"creator_addr"`
+	Regex       string `json:"regex"`
+	Format      string `json:"format"`
+	FieldExpr   string `json:"field_expr,omitempty"`
+}
+
+func marshalFilter(f *Filter) ([]byte, error) {
+	return json.Marshal(storedFilter{
+		Id:          f.Id,
+		Name:        f.Name,
+		CreatorAddr: f.CreatorAddr,
+		Regex:       f.Regex,
+		Format:      f.Format,
+		FieldExpr:   f.FieldExpr,
+	})
+}
+
+// resultKey returns the big-endian encoding of a timestamp so bucket keys
+// (and therefore results) sort chronologically.
+func resultKey(ts int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(ts))
+	return key
+}
@@ -7,138 +7,184 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/RobinUS2/golang-jresp"
-	"github.com/julienschmidt/httprouter"
 	"log"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/gin-gonic/gin"
 )
 
 var serverPort int
+var authMode string
 var basicAuthUsr string
 var basicAuthPwd string
+var oidcIssuer string
+var oidcAudience string
+var oidcClientId string
 var dbFile string
+var retentionMaxAge time.Duration
+var retentionMaxLines int
+var retentionMaxBytes int64
 var filterManager *FilterManager
+var authenticator Authenticator
 
 func init() {
 	flag.IntVar(&serverPort, "port", 1525, "Server port")
-	flag.StringVar(&basicAuthUsr, "auth-user", "cloud", "Username")
-	flag.StringVar(&basicAuthPwd, "auth-password", "pelican", "Password")
+	flag.StringVar(&authMode, "auth-mode", AuthModeBasic, "Authentication mode: basic|bearer|oidc")
+	flag.StringVar(&basicAuthUsr, "auth-user", "cloud", "Username (basic auth mode)")
+	flag.StringVar(&basicAuthPwd, "auth-password", "pelican", "Password (basic auth mode) or static token (bearer auth mode)")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "OIDC discovery issuer URL (oidc auth mode)")
+	flag.StringVar(&oidcAudience, "oidc-audience", "", "Expected OIDC token audience (oidc auth mode)")
+	flag.StringVar(&oidcClientId, "oidc-client-id", "", "OIDC client id (oidc auth mode)")
 	flag.StringVar(&dbFile, "db-file", "cloudpelican_lsd_supervisor.db", "Database file")
+	flag.DurationVar(&retentionMaxAge, "retention-max-age", 7*24*time.Hour, "Maximum age of stored results before they're compacted away, 0 disables")
+	flag.IntVar(&retentionMaxLines, "retention-max-lines", 1000000, "Maximum number of stored results per filter, 0 disables")
+	flag.Int64Var(&retentionMaxBytes, "retention-max-bytes", 0, "Maximum bytes of stored results per filter, 0 disables")
 	flag.Parse()
 }
 
 func main() {
-	// Filter manager
-	filterManager = NewFilterManager()
+	// Authenticator
+	var err error
+	authenticator, err = newAuthenticator(authMode, basicAuthUsr, basicAuthPwd, oidcIssuer, oidcAudience, oidcClientId)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Store + filter manager, rehydrated from disk
+	store, err := NewBoltStore(dbFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	filterManager, err = NewFilterManagerWithStore(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go runCompactor(filterManager)
 
 	// Routing
-	router := httprouter.New()
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(RequestID())
+	router.Use(StructuredLogger())
+	router.Use(CORS())
+	router.Use(Gzip())
 
 	// Docs
-	router.GET("/", GetHome)
+	router.GET("/", RequireScope(ScopeFilterRead), GetHome)
 
 	// Filters
-	router.POST("/filter", PostFilter)
-	router.GET("/filter/:id/result", GetFilterResult)
-	router.PUT("/filter/:id/result", PutFilterResult)
-	router.GET("/filter", GetFilter)
-	router.DELETE("/filter/:id", DeleteFilter)
+	router.POST("/filter", RequireScope(ScopeFilterWrite), PostFilter)
+	router.GET("/filter/:id/result", RequireScope(ScopeFilterRead), GetFilterResult)
+	router.PUT("/filter/:id/result", RequireScope(ScopeFilterWrite), PutFilterResult)
+	router.GET("/filter/:id/stream", RequireScope(ScopeFilterRead), StreamFilterResult)
+	router.GET("/filter", RequireScope(ScopeFilterRead), GetFilter)
+	router.DELETE("/filter/:id", RequireScope(ScopeFilterAdmin), DeleteFilter)
 
 	// Start webserver
 	log.Println(fmt.Sprintf("Starting supervisor service at port %d", serverPort))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", serverPort), router))
+	log.Fatal(router.Run(fmt.Sprintf(":%d", serverPort)))
 }
 
-func GetHome(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	if !basicAuth(w, r) {
-		return
-	}
+func GetHome(c *gin.Context) {
 	jresp := jresp.NewJsonResp()
 	jresp.Set("hello", "This is the CloudPelican supervisor")
 	jresp.OK()
-	fmt.Fprint(w, jresp.ToString(false))
+	writeJresp(c, jresp)
+}
+
+type postFilterQuery struct {
+	Regex     string `form:"regex"`
+	Name      string `form:"name"`
+	Format    string `form:"format"`
+	FieldExpr string `form:"field_expr"`
 }
 
-func PostFilter(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	if !basicAuth(w, r) {
+func PostFilter(c *gin.Context) {
+	jresp := jresp.NewJsonResp()
+
+	var q postFilterQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		jresp.Error(fmt.Sprintf("Invalid query: %s", err))
+		writeJresp(c, jresp)
 		return
 	}
-	jresp := jresp.NewJsonResp()
 
 	// Validate
-	regex := strings.TrimSpace(r.URL.Query().Get("regex"))
+	regex := strings.TrimSpace(q.Regex)
 	if len(regex) < 1 {
 		jresp.Error("Please provide a regex")
-		fmt.Fprint(w, jresp.ToString(false))
+		writeJresp(c, jresp)
 		return
 	}
-	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	name := strings.TrimSpace(q.Name)
 	if len(name) < 1 {
 		jresp.Error("Please provide a name")
-		fmt.Fprint(w, jresp.ToString(false))
+		writeJresp(c, jresp)
 		return
 	}
+	format := strings.TrimSpace(q.Format)
+	if len(format) < 1 {
+		format = FormatRaw
+	}
+	fieldExpr := strings.TrimSpace(q.FieldExpr)
 
 	// Create filter
-	id, err := filterManager.CreateFilter(name, r.RemoteAddr, regex)
+	id, err := filterManager.CreateStructuredFilter(name, c.ClientIP(), regex, format, fieldExpr)
 	if err != nil {
 		jresp.Error(fmt.Sprintf("Failed to create filter: %s", err))
-		fmt.Fprint(w, jresp.ToString(false))
+		writeJresp(c, jresp)
 		return
 	}
 
 	// OK :)
 	jresp.Set("filter_id", id)
 	jresp.OK()
-	fmt.Fprint(w, jresp.ToString(false))
+	writeJresp(c, jresp)
 }
 
-func GetFilterResult(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	if !basicAuth(w, r) {
-		return
-	}
+func GetFilterResult(c *gin.Context) {
 	jresp := jresp.NewJsonResp()
-	id := strings.TrimSpace(ps.ByName("id"))
+	id := strings.TrimSpace(c.Param("id"))
 	if len(id) < 1 {
 		jresp.Error("Please provide an ID")
-		fmt.Fprint(w, jresp.ToString(false))
+		writeJresp(c, jresp)
 		return
 	}
 	filter := filterManager.GetFilter(id)
 	if filter == nil {
 		jresp.Error(fmt.Sprintf("Filter %s not found", id))
-		fmt.Fprint(w, jresp.ToString(false))
+		writeJresp(c, jresp)
 		return
 	}
-	jresp.Set("results", filter.Results)
+	jresp.Set("results", filter.ResultsSnapshot())
 	jresp.OK()
-	fmt.Fprint(w, jresp.ToString(false))
+	writeJresp(c, jresp)
 }
 
-func PutFilterResult(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	if !basicAuth(w, r) {
-		return
-	}
+func PutFilterResult(c *gin.Context) {
 	jresp := jresp.NewJsonResp()
-	id := strings.TrimSpace(ps.ByName("id"))
+	id := strings.TrimSpace(c.Param("id"))
 	if len(id) < 1 {
 		jresp.Error("Please provide an ID")
-		fmt.Fprint(w, jresp.ToString(false))
+		writeJresp(c, jresp)
 		return
 	}
 	filter := filterManager.GetFilter(id)
 	if filter == nil {
 		jresp.Error(fmt.Sprintf("Filter %s not found", id))
-		fmt.Fprint(w, jresp.ToString(false))
+		writeJresp(c, jresp)
 		return
 	}
 
 	// Read body
-	scanner := bufio.NewScanner(r.Body)
+	scanner := bufio.NewScanner(c.Request.Body)
 	scanner.Split(bufio.ScanLines)
 	var lines []string = make([]string, 0)
 	for scanner.Scan() {
@@ -150,69 +196,115 @@ func PutFilterResult(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	jresp.Set("ack", res)
 	jresp.Set("lines", len(lines))
 	jresp.OK()
-	fmt.Fprint(w, jresp.ToString(false))
+	writeJresp(c, jresp)
 }
 
-func GetFilter(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	if !basicAuth(w, r) {
+// streamHeartbeatInterval is how often a comment is sent to idle /stream
+// connections so intermediate proxies don't time them out.
+const streamHeartbeatInterval = 15 * time.Second
+
+// streamDeadline bounds how long a single /stream connection may stay open
+// in total, counted from when it was opened and not reset by activity, so a
+// forgotten tab doesn't pin a goroutine and subscriber buffer forever.
+const streamDeadline = 1 * time.Hour
+
+func StreamFilterResult(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	filter := filterManager.GetFilter(id)
+	if filter == nil {
+		c.String(http.StatusNotFound, fmt.Sprintf("Filter %s not found", id))
 		return
 	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.String(http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+
+	subId, ch := filter.Subscribe()
+	defer filter.Unsubscribe(subId)
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	deadline := time.NewTimer(streamDeadline)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case res, open := <-ch:
+			if !open {
+				return
+			}
+			data, err := json.Marshal(res)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-deadline.C:
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+func GetFilter(c *gin.Context) {
 	jresp := jresp.NewJsonResp()
 	filters := filterManager.GetFilters()
-	var filtersNoRes []*Filter = make([]*Filter, 0)
+	summaries := make([]*FilterSummary, 0, len(filters))
 	for _, filter := range filters {
-		filter.Results = nil
-		filtersNoRes = append(filtersNoRes, filter)
+		summaries = append(summaries, filter.Summary())
 	}
-	jresp.Set("filters", filtersNoRes)
+	jresp.Set("filters", summaries)
 	jresp.OK()
-	fmt.Fprint(w, jresp.ToString(false))
+	writeJresp(c, jresp)
 }
 
-func DeleteFilter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	if !basicAuth(w, r) {
-		return
-	}
+func DeleteFilter(c *gin.Context) {
 	jresp := jresp.NewJsonResp()
-	id := strings.TrimSpace(ps.ByName("id"))
+	id := strings.TrimSpace(c.Param("id"))
 	if len(id) < 1 {
 		jresp.Error("Please provide an ID")
-		fmt.Fprint(w, jresp.ToString(false))
+		writeJresp(c, jresp)
 		return
 	}
 	res := filterManager.DeleteFilter(id)
 	jresp.Set("deleted", res)
 	jresp.OK()
-	fmt.Fprint(w, jresp.ToString(false))
+	writeJresp(c, jresp)
 }
 
-func basicAuth(w http.ResponseWriter, r *http.Request) bool {
-	if r.Header["Authorization"] == nil || len(r.Header["Authorization"]) < 1 {
-		log.Printf("%s", r.Header)
-		http.Error(w, "bad syntax a", http.StatusBadRequest)
-		return false
-	}
-	auth := strings.SplitN(r.Header["Authorization"][0], " ", 2)
+// compactInterval is how often the retention policy runs against every
+// filter's stored results.
+const compactInterval = 5 * time.Minute
 
-	if len(auth) != 2 || auth[0] != "Basic" {
-		log.Printf("%s", r.Header)
-		http.Error(w, "bad syntax b", http.StatusBadRequest)
-		return false
+// runCompactor periodically enforces the configured retention policy. It's
+// expected to run for the lifetime of the process as its own goroutine.
+func runCompactor(fm *FilterManager) {
+	policy := RetentionPolicy{
+		MaxAge:   retentionMaxAge,
+		MaxLines: retentionMaxLines,
+		MaxBytes: retentionMaxBytes,
 	}
-
-	payload, _ := base64.StdEncoding.DecodeString(auth[1])
-	pair := strings.SplitN(string(payload), ":", 2)
-
-	if len(pair) != 2 || !validateAuth(pair[0], pair[1]) {
-		http.Error(w, "authorization failed", http.StatusUnauthorized)
-		return false
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fm.Compact(policy)
 	}
-	return true
 }
 
-func validateAuth(username, password string) bool {
-	if username == basicAuthUsr && password == basicAuthPwd {
-		return true
-	}
-	return false
-}
\ No newline at end of file
+// writeJresp writes a jresp response the same way the handlers always have:
+// 200 OK with the jresp-encoded JSON body, success or not, and the caller
+// inspects the `status` field to tell the two apart.
+func writeJresp(c *gin.Context, resp *jresp.JsonResp) {
+	c.Data(http.StatusOK, "application/json", []byte(resp.ToString(false)))
+}